@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/mmap"
+	"golang.org/x/tools/go/gcexportdata"
+)
+
+// indexWG tracks in-flight cacheIndex goroutines. The one-shot CLI waits on
+// it when main returns, so a freshly type-checked package's index entry
+// finishes writing instead of being killed mid-write by process exit. Exits
+// through os.Exit (fail, a recents hit in raceWithRecents, log.Fatalf) do
+// not wait.
+var indexWG sync.WaitGroup
+
+var indexDir = os.ExpandEnv("$HOME/.cache/gosym/index")
+
+// posEntry records that the identifier at Ident resolves to the object
+// defined at Def, both printed in fset.Position().String() form.
+type posEntry struct {
+	Ident string
+	Def   string
+}
+
+// actionID summarizes everything that makes a type-checked package stale:
+// the module it lives in, the Go toolchain version, and the size/mtime of
+// every file that went into it (or, for a file with an active overlay, the
+// hash of its unsaved content instead). ov is a snapshot of the overlays in
+// effect for this lookup, passed in rather than read from the package-level
+// overlays map, so a caller that holds onto the result (cacheIndex's
+// background goroutine) can't race a later request that reassigns that map.
+// That keeps an overlay on a dependency's file from being served stale from
+// a pre-overlay index entry, or from poisoning the index for readers
+// without that overlay.
+func actionID(modRoot string, fns []string, ov map[string][]byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "go=%s modroot=%s\n", runtime.Version(), modRoot)
+
+	sorted := append([]string(nil), fns...)
+	sort.Strings(sorted)
+	for _, fn := range sorted {
+		if b, ok := ov[fn]; ok {
+			fmt.Fprintf(h, "%s overlay:%s\n", fn, sha(b))
+			continue
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			fmt.Fprintf(h, "%s missing\n", fn)
+			continue
+		}
+		fmt.Fprintf(h, "%s %d %d\n", fn, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func indexPath(pkgPath, id string) string {
+	name := strings.Replace(pkgPath, "/", "_", -1)
+	return filepath.Join(indexDir, name+"-"+id)
+}
+
+// writeIndex persists pkg's export data plus the ident->def position table
+// for pkgPath under indexDir, keyed by the ActionID id. It writes to a temp
+// file in the same directory and renames it into place, so a reader never
+// sees a partial file and two concurrent writers for the same pkgPath+id
+// can't interleave into a corrupt one.
+func writeIndex(pkgPath, id string, pkg *types.Package, positions []posEntry) {
+	var exported bytes.Buffer
+	if err := gcexportdata.Write(&exported, fset, pkg); err != nil {
+		lg("encode export data pkg=%s err=%v", pkgPath, err)
+		return
+	}
+
+	dir := indexDir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		lg("mkdir index dir pkg=%s err=%v", pkgPath, err)
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, "idx-*")
+	if err != nil {
+		lg("create temp index pkg=%s err=%v", pkgPath, err)
+		return
+	}
+	defer os.Remove(tmp.Name()) // no-op once the rename below succeeds
+
+	var hdr [8]byte
+	binary.BigEndian.PutUint64(hdr[:], uint64(exported.Len()))
+	if _, err := tmp.Write(hdr[:]); err != nil {
+		lg("write index hdr pkg=%s err=%v", pkgPath, err)
+		tmp.Close()
+		return
+	}
+	if _, err := tmp.Write(exported.Bytes()); err != nil {
+		lg("write index data pkg=%s err=%v", pkgPath, err)
+		tmp.Close()
+		return
+	}
+	if err := json.NewEncoder(tmp).Encode(positions); err != nil {
+		lg("write index positions pkg=%s err=%v", pkgPath, err)
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		lg("close temp index pkg=%s err=%v", pkgPath, err)
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), indexPath(pkgPath, id)); err != nil {
+		lg("rename index pkg=%s err=%v", pkgPath, err)
+	}
+}
+
+// readIndex mmaps the index file for pkgPath@id and decodes it, returning
+// ok=false if the file is missing or unreadable (i.e. the ActionID is stale
+// or no index was ever written).
+func readIndex(pkgPath, id string) (pkg *types.Package, positions []posEntry, ok bool) {
+	r, err := mmap.Open(indexPath(pkgPath, id))
+	if err != nil {
+		return nil, nil, false
+	}
+	defer r.Close()
+
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, nil, false
+	}
+	n := int64(binary.BigEndian.Uint64(hdr[:]))
+
+	pkgs := make(map[string]*types.Package)
+	pkg, err = gcexportdata.Read(io.NewSectionReader(r, 8, n), fset, pkgs, pkgPath)
+	if err != nil {
+		lg("decode index pkg=%s err=%v", pkgPath, err)
+		return nil, nil, false
+	}
+
+	rest := io.NewSectionReader(r, 8+n, int64(r.Len())-8-n)
+	if err := json.NewDecoder(rest).Decode(&positions); err != nil {
+		lg("decode index positions pkg=%s err=%v", pkgPath, err)
+		return nil, nil, false
+	}
+	return pkg, positions, true
+}
+
+// importIndexedPkg looks up pkgPath in the on-disk index, returning ok=false
+// if no entry matches the package's current ActionID.
+func importIndexedPkg(pkgPath string) (*types.Package, bool) {
+	fns, _ := pkgFiles(pkgPath)
+	if len(fns) == 0 {
+		return nil, false
+	}
+	modRoot, _ := findModule(filepath.Dir(fns[0]))
+	id := actionID(modRoot, fns, overlays)
+
+	pkg, _, ok := readIndex(pkgPath, id)
+	if !ok {
+		return nil, false
+	}
+	lg("import pkg=%s using on-disk index", pkgPath)
+	return pkg, true
+}
+
+// findIndexedPos reports the cached definition position of target, the
+// cursor's own package's identifier, using the on-disk ident->def position
+// table built by cacheIndex the last time myPkg was type-checked. It is the
+// on-disk counterpart to findRecentPos: the recents cache remembers a
+// handful of individually-visited idents, while the index's position table
+// covers every same-package ident in myPkg as of its last index write, so
+// it can serve a lookup the recents cache has never seen. It only ever
+// misses (never wrongly hits) on a target resolving outside myPkg: per
+// cacheIndex, the table holds no cross-package entries, so those always
+// fall through to the authoritative twoPass/parseProgram resolution.
+func findIndexedPos(myPkg string, target *ast.Ident) (string, bool) {
+	fns, _ := pkgFiles(myPkg)
+	if len(fns) == 0 {
+		return "", false
+	}
+	modRoot, _ := findModule(filepath.Dir(fns[0]))
+	id := actionID(modRoot, fns, overlays)
+
+	_, positions, ok := readIndex(myPkg, id)
+	if !ok {
+		return "", false
+	}
+
+	key := printPos(target.Pos())
+	for _, p := range positions {
+		if p.Ident == key {
+			return p.Def, true
+		}
+	}
+	return "", false
+}
+
+// cacheIndex builds the position table for a freshly type-checked pkg and
+// writes it to the on-disk index so later lookups can skip type-checking.
+// ov must be a snapshot of the overlays active when pkg was checked, not the
+// live package-level overlays map: cacheIndex runs in a background
+// goroutine, and in -serve mode the next request reassigns that map before
+// this goroutine is guaranteed to finish.
+//
+// The position table only records entries whose resolved object belongs to
+// pkgPath itself, never a cross-package Uses entry. pkg may have been
+// checked with an importer.Default() pass, as findInMyPkg and importSrcPkg
+// do (see the BUG:...13898 comment on findInMyPkg),
+// whose cross-package object identities twoPass's second, source-based pass
+// doesn't trust; serving one from the index would let the fast path return
+// a position the authoritative slow path wouldn't. It also means an
+// overlay on some dependency's file can never make pkgPath's own ActionID
+// stale without actually changing pkgPath's own position table, since that
+// table never depended on the dependency's content in the first place.
+func cacheIndex(pkgPath string, fns []string, pkg *types.Package, info *types.Info, ov map[string][]byte) {
+	if len(fns) == 0 {
+		return
+	}
+	modRoot, _ := findModule(filepath.Dir(fns[0]))
+	id := actionID(modRoot, fns, ov)
+
+	var positions []posEntry
+	add := func(ident *ast.Ident, obj types.Object) {
+		if obj == nil || obj.Pos() == token.NoPos {
+			return
+		}
+		if obj.Pkg() == nil || obj.Pkg().Path() != pkgPath {
+			return
+		}
+		positions = append(positions, posEntry{Ident: printPos(ident.Pos()), Def: printPos(obj.Pos())})
+	}
+	for ident, obj := range info.Defs {
+		add(ident, obj)
+	}
+	for ident, obj := range info.Uses {
+		add(ident, obj)
+	}
+
+	writeIndex(pkgPath, id, pkg, positions)
+}
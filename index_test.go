@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+// TestCacheIndexOmitsCrossPackagePositions is a regression test for the
+// overlay-staleness bug described in the chunk0-5 review: if cacheIndex
+// recorded a cross-package position, a dependency's ActionID could go
+// stale (e.g. from an overlay) without changing the indexed package's own
+// ActionID, since that only hashes the indexed package's own files. Since
+// cacheIndex only ever records positions resolving inside the indexed
+// package itself, that staleness gap can't open up.
+func TestCacheIndexOmitsCrossPackagePositions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosym-index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origIndexDir := indexDir
+	indexDir = dir
+	defer func() { indexDir = origIndexDir }()
+
+	const depSrc = `package dep
+
+func Sym() int { return 1 }
+`
+	const mainSrc = `package main2
+
+import "example.com/dep"
+
+func use() int {
+	return dep.Sym()
+}
+`
+	depFile := parseFile("index_test_dep.go", []byte(depSrc))
+	mainFile := parseFile("index_test_main2.go", []byte(mainSrc))
+
+	depInfo := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	depPkg, err := new(types.Config).Check("example.com/dep", fset, []*ast.File{depFile}, depInfo)
+	if err != nil {
+		t.Fatalf("check dep: %v", err)
+	}
+
+	cfg := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if path == "example.com/dep" {
+				return depPkg, nil
+			}
+			return nil, fmt.Errorf("unexpected import %q", path)
+		}),
+	}
+	mainInfo := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	mainPkg, err := cfg.Check("example.com/main2", fset, []*ast.File{mainFile}, mainInfo)
+	if err != nil {
+		t.Fatalf("check main2: %v", err)
+	}
+
+	fns := []string{"index_test_main2.go"}
+	cacheIndex("example.com/main2", fns, mainPkg, mainInfo, overlays)
+
+	modRoot, _ := findModule(filepath.Dir(fns[0]))
+	id := actionID(modRoot, fns, overlays)
+	_, positions, ok := readIndex("example.com/main2", id)
+	if !ok {
+		t.Fatal("expected cacheIndex to have written an index entry")
+	}
+
+	depSymPos := printPos(depPkg.Scope().Lookup("Sym").Pos())
+	for _, p := range positions {
+		if p.Def == depSymPos {
+			t.Fatalf("index recorded a cross-package position pointing at dep.Sym: %+v", p)
+		}
+	}
+}
+
+// TestActionIDStaleness checks the two things the index depends on to know
+// when it's safe to reuse an entry: a file's mtime changing (or an active
+// overlay, which sidesteps mtime entirely) must change the ActionID, and an
+// unchanged file must keep producing the same one.
+func TestActionIDStaleness(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosym-actionid-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(fn, []byte("package a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := actionID("example.com/mod", []string{fn}, nil)
+	if again := actionID("example.com/mod", []string{fn}, nil); again != fresh {
+		t.Fatalf("actionID changed with no change to the file: %s vs %s", fresh, again)
+	}
+
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(fn, future, future); err != nil {
+		t.Fatal(err)
+	}
+	stale := actionID("example.com/mod", []string{fn}, nil)
+	if stale == fresh {
+		t.Fatal("expected actionID to change after the file's mtime changed")
+	}
+
+	ov := map[string][]byte{fn: []byte("package a\n\nvar X int\n")}
+	overlaid := actionID("example.com/mod", []string{fn}, ov)
+	if overlaid == stale {
+		t.Fatal("expected an overlay to change actionID independent of the file's on-disk mtime")
+	}
+}
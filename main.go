@@ -10,7 +10,6 @@ import (
 	"flag"
 	"fmt"
 	"go/ast"
-	"go/build"
 	"go/importer"
 	"go/parser"
 	"go/token"
@@ -19,6 +18,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -27,6 +27,7 @@ import (
 
 	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
 var (
@@ -36,8 +37,36 @@ var (
 	stdin     = flag.Bool("i", false, "read file from stdin")
 	godef     = flag.String("godef", "godef.orig", "path to godef")
 	cacheFile = flag.String("cache", os.ExpandEnv("$HOME/.cache/gosym.recent"), "recent go symbols")
+
+	serveFlag  = flag.Bool("serve", false, "run as a resident daemon instead of a one-shot lookup")
+	socketPath = flag.String("socket", os.ExpandEnv("$HOME/.cache/gosym/gosym.sock"), "unix socket the daemon listens on / the client connects to")
+
+	refsFlag = flag.Bool("refs", false, "find references to the identifier instead of its definition")
+
+	overlayFlag = flag.String("overlay", "", "path to a JSON file of the form {\"Replace\": {\"/abs/path.go\": \"/tmp/buf1\"}}, same schema as gopls")
 )
 
+// overlays maps an absolute file path to unsaved buffer content that should
+// be used instead of reading the file from disk: entries come from -overlay
+// and, for the file under the cursor, from stdin (-i) or a daemon request.
+var overlays = map[string][]byte{}
+
+// snapshotOverlays copies the current overlays map so a caller that hands
+// the copy to a background goroutine (cacheIndex, via indexWG) is immune to
+// -serve reassigning the package-level overlays map for the next request
+// before that goroutine finishes.
+func snapshotOverlays() map[string][]byte {
+	snap := make(map[string][]byte, len(overlays))
+	for k, v := range overlays {
+		snap[k] = v
+	}
+	return snap
+}
+
+// daemonMode is true while running under -serve, so code shared with the
+// CLI (like reading the target file) can avoid os.Exit on a bad request.
+var daemonMode bool
+
 func lg(format string, arg ...interface{}) {
 	if *verbose {
 		_, fn, ln, _ := runtime.Caller(1)
@@ -46,6 +75,12 @@ func lg(format string, arg ...interface{}) {
 }
 
 func parseFile(fn string, src interface{}) *ast.File {
+	if src == nil {
+		if b, ok := overlays[fn]; ok {
+			src = b
+		}
+	}
+
 	f, err := parser.ParseFile(fset, fn, src, parser.AllErrors)
 	if err != nil {
 		// error is expected
@@ -54,13 +89,76 @@ func parseFile(fn string, src interface{}) *ast.File {
 	return f
 }
 
+// loadOverlayFile reads the gopls-style overlay file at fn and returns the
+// replacement content of each listed path, keyed by the original path.
+func loadOverlayFile(fn string) (map[string][]byte, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string][]byte, len(cfg.Replace))
+	for path, replacement := range cfg.Replace {
+		body, err := ioutil.ReadFile(replacement)
+		if err != nil {
+			return nil, fmt.Errorf("overlay read replacement=%s for path=%s: %v", replacement, path, err)
+		}
+		out[path] = body
+	}
+	return out, nil
+}
+
 func pkgPath(fn string) string {
 	dir := filepath.Dir(fn)
-	i := strings.LastIndex(dir, "/src/")
-	if i < 0 {
-		return "main"
+	if mod, root := findModule(dir); mod != "" {
+		rel, err := filepath.Rel(root, dir)
+		if err == nil {
+			if rel == "." {
+				return mod
+			}
+			return path.Join(mod, filepath.ToSlash(rel))
+		}
+	}
+
+	// fall back to GOPATH semantics for trees without a go.mod
+	if i := strings.LastIndex(dir, "/src/"); i >= 0 {
+		return dir[i+len("/src/"):]
+	}
+	return "main"
+}
+
+// findModule walks up from dir looking for a go.mod and returns the module
+// path it declares along with the directory containing it.
+func findModule(dir string) (modPath, root string) {
+	for {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			return modulePath(b), dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ""
+		}
+		dir = parent
+	}
+}
+
+func modulePath(gomod []byte) string {
+	for _, line := range strings.Split(string(gomod), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "module ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "module"))
+		}
 	}
-	return dir[i+len("/src/"):]
+	return ""
 }
 
 func tokenFile(f *ast.File) *token.File {
@@ -71,30 +169,96 @@ func printPos(pos token.Pos) string {
 	return fset.Position(pos).String()
 }
 
+// pkgFilesCache memoizes CompiledGoFiles by import path across the whole
+// dependency graph that a single packages.Load(NeedDeps) call already walks
+// for the cursor's own package. Without it, every ActionID computation for
+// an imported package (on each definition/reference lookup) would re-run a
+// fresh go/packages load (a go list subprocess) just to name its files,
+// which is far slower than the type-check the index exists to avoid.
+// resetPkgFilesCache clears it between -serve requests, since a fresh
+// request may have a different overlay set and file layout.
+var pkgFilesCache = struct {
+	mu   sync.Mutex
+	data map[string][]string
+}{data: make(map[string][]string)}
+
+func resetPkgFilesCache() {
+	pkgFilesCache.mu.Lock()
+	defer pkgFilesCache.mu.Unlock()
+	pkgFilesCache.data = make(map[string][]string)
+}
+
+func cachedPkgFiles(p string) ([]string, bool) {
+	pkgFilesCache.mu.Lock()
+	defer pkgFilesCache.mu.Unlock()
+	fns, ok := pkgFilesCache.data[p]
+	return fns, ok
+}
+
+// cachePkgGraph records CompiledGoFiles for pkg and, recursively, for every
+// package NeedDeps pulled transitively into pkg.Imports, so a later
+// pkgFiles call for any of them is a cache hit instead of a fresh load.
+func cachePkgGraph(pkg *packages.Package) {
+	pkgFilesCache.mu.Lock()
+	defer pkgFilesCache.mu.Unlock()
+	seen := make(map[string]bool)
+	var walk func(p *packages.Package)
+	walk = func(p *packages.Package) {
+		if seen[p.PkgPath] {
+			return
+		}
+		seen[p.PkgPath] = true
+		pkgFilesCache.data[p.PkgPath] = p.CompiledGoFiles
+		for _, imp := range p.Imports {
+			walk(imp)
+		}
+	}
+	walk(pkg)
+}
+
 func pkgFiles(p string) (files, imports []string) {
-	pkg, err := build.Import(p, "", 0)
-	if err != nil {
-		lg("import pkg=%s err=%v pkg=%+v", p, err, pkg)
+	if fns, ok := cachedPkgFiles(p); ok {
+		return fns, nil
+	}
+
+	cfg := &packages.Config{
+		Mode:    packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedDeps | packages.NeedModule,
+		Dir:     filepath.Dir(*filename),
+		Tests:   isTestFile(*filename),
+		Overlay: overlays,
+	}
+	pkgs, err := packages.Load(cfg, p)
+	if err != nil || len(pkgs) == 0 {
+		lg("load pkg=%s err=%v", p, err)
 		return nil, nil
 	}
 
-	isTest := isTestFile(*filename)
-	n := len(pkg.GoFiles)
-	m := n
-	if isTest {
-		n += len(pkg.TestGoFiles)
+	pkg := pkgContaining(pkgs, *filename)
+	if len(pkg.Errors) > 0 {
+		lg("load pkg=%s errs=%v", p, pkg.Errors)
 	}
+	cachePkgGraph(pkg)
 
-	out := make([]string, n)
-	for i, f := range pkg.GoFiles {
-		out[i] = filepath.Join(pkg.Dir, f)
+	imports = make([]string, 0, len(pkg.Imports))
+	for imp := range pkg.Imports {
+		imports = append(imports, imp)
 	}
-	if isTest {
-		for i, f := range pkg.TestGoFiles {
-			out[m+i] = filepath.Join(pkg.Dir, f)
+	return pkg.CompiledGoFiles, imports
+}
+
+// pkgContaining returns the packages.Load result that actually compiles fn,
+// falling back to pkgs[0]. With Tests:true, packages.Load can return both
+// the plain package and its test-augmented variant for the same import
+// path, and only the latter compiles a _test.go file under edit.
+func pkgContaining(pkgs []*packages.Package, fn string) *packages.Package {
+	for _, pkg := range pkgs {
+		for _, f := range pkg.CompiledGoFiles {
+			if f == fn {
+				return pkg
+			}
 		}
 	}
-	return out, pkg.Imports
+	return pkgs[0]
 }
 
 func isTestFile(fn string) bool {
@@ -123,12 +287,18 @@ func parseMyPkg() (myPkg string, fs []*ast.File, imports []string, chain []ast.N
 		var err error
 
 		if fn == *filename {
-			if *stdin {
+			if b, ok := overlays[fn]; ok {
+				fileBody = b
+			} else if *stdin {
 				fileBody, err = ioutil.ReadAll(os.Stdin)
 			} else {
 				fileBody, err = ioutil.ReadFile(fn)
 			}
 			if err != nil {
+				if daemonMode {
+					lg("read file=%s err=%v", fn, err)
+					return "", nil, nil, nil
+				}
 				log.Fatalf("read stdin or file=%s err=%v", fn, err)
 			}
 			fileSHA1 = sha(fileBody)
@@ -184,7 +354,25 @@ func importSrcPkg(cfg *types.Config, path string) (*types.Package, error) {
 		fs = append(fs, f)
 	}
 
-	return cfg.Check(path, fset, fs, nil)
+	info := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	pkg, err := cfg.Check(path, fset, fs, info)
+	if err == nil && pkg != nil {
+		ov := snapshotOverlays()
+		indexWG.Add(1)
+		go func() {
+			defer indexWG.Done()
+			cacheIndex(path, fns, pkg, info, ov)
+		}()
+		if daemonMode {
+			if id, ok := viewActionID(path); ok {
+				theView.put(path, id, pkg)
+			}
+		}
+	}
+	return pkg, err
 }
 
 func (si srcImporter) Import(path string) (*types.Package, error) {
@@ -210,6 +398,24 @@ func newHybridImporter(pkgInUse string) *hybridImporter {
 
 func (hi *hybridImporter) Import(path string) (pkg *types.Package, err error) {
 	if hi.pkgInUse != path {
+		if daemonMode {
+			if id, ok := viewActionID(path); ok {
+				if pkg, ok := theView.get(path, id); ok {
+					lg("import pkg=%s using in-memory view", path)
+					return pkg, nil
+				}
+			}
+		}
+
+		if pkg, ok := importIndexedPkg(path); ok {
+			if daemonMode {
+				if id, ok := viewActionID(path); ok {
+					theView.put(path, id, pkg)
+				}
+			}
+			return pkg, nil
+		}
+
 		lg("import pkg=%s using default importer", path)
 		if pkg, err = hi.cfg.Importer.Import(path); err == nil {
 			return pkg, nil
@@ -255,9 +461,23 @@ func findInMyPkg(myPkg string, fs []*ast.File, target *ast.Ident) (obj types.Obj
 		DisableUnusedImportCheck: true,
 	}
 	info := types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
 		Uses: make(map[*ast.Ident]types.Object),
 	}
-	cfg.Check(myPkg, fset, fs, &info)
+	pkg, err := cfg.Check(myPkg, fset, fs, &info)
+	if err == nil && pkg != nil {
+		// Index myPkg itself, not just the dependencies importSrcPkg sees:
+		// otherwise findIndexedPos's fast path never fires for the common
+		// case of the cursor landing inside the package being edited.
+		if fns, _ := pkgFiles(myPkg); len(fns) > 0 {
+			ov := snapshotOverlays()
+			indexWG.Add(1)
+			go func() {
+				defer indexWG.Done()
+				cacheIndex(myPkg, fns, pkg, &info, ov)
+			}()
+		}
+	}
 
 	if obj = info.Uses[target]; obj == nil {
 		lg("object of target=%v not found", target)
@@ -352,26 +572,26 @@ type recentObjects struct {
 
 var recents *recentObjects
 
-func findRecent(ident *ast.Ident) {
+// findRecentPos reports the cached position of ident's definition, if the
+// cache entry is still fresh.
+func findRecentPos(ident *ast.Ident) (string, bool) {
 	if recents == nil {
-		return
+		return "", false
 	}
 
 	k := printPos(ident.Pos())
 
 	ent, ok := recents.entries[k]
 	if !ok {
-		return
+		return "", false
 	}
 
 	if !validEntry(ent) {
 		ent.bad = true
-		return
+		return "", false
 	}
 
-	lg("find in recent")
-	fmt.Println(ent.ToPos)
-	os.Exit(0)
+	return ent.ToPos, true
 }
 
 func validEntry(ent *objectEntry) bool {
@@ -393,6 +613,10 @@ func validEntry(ent *objectEntry) bool {
 }
 
 func fileSHA(fn string) string {
+	if b, ok := overlays[fn]; ok {
+		return sha(b)
+	}
+
 	b, err := ioutil.ReadFile(fn)
 	if err != nil {
 		return ""
@@ -467,17 +691,11 @@ func saveRecent(ident *ast.Ident, obj types.Object) {
 	}
 }
 
+// parallelPass races the two whole-package resolution strategies and
+// returns whichever finds the target object first. It has no dependency on
+// the recents cache, so it is safe to call from both the one-shot CLI and
+// the -serve daemon.
 func parallelPass(myPkg string, fs []*ast.File, target *ast.Ident) types.Object {
-	var wg sync.WaitGroup
-	if recents != nil {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			findRecent(target)
-		}()
-	}
-	defer wg.Wait()
-
 	out := make(chan types.Object, 2)
 	go func() {
 		obj := twoPass(myPkg, fs, target)
@@ -502,6 +720,30 @@ func parallelPass(myPkg string, fs []*ast.File, target *ast.Ident) types.Object
 	return nil
 }
 
+// raceWithRecents is the CLI-only fast path: it races the recents-cache
+// lookup against parallelPass and, on a cache hit, prints the cached
+// position and exits the process immediately. It must not be used by the
+// daemon, which cannot afford to have a goroutine call os.Exit.
+func raceWithRecents(myPkg string, fs []*ast.File, target *ast.Ident) types.Object {
+	if recents == nil {
+		return parallelPass(myPkg, fs, target)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if pos, ok := findRecentPos(target); ok {
+			lg("find in recent")
+			fmt.Println(pos)
+			os.Exit(0)
+		}
+	}()
+	defer wg.Wait()
+
+	return parallelPass(myPkg, fs, target)
+}
+
 var fset = token.NewFileSet()
 
 func main() {
@@ -512,8 +754,63 @@ func main() {
 	flag.Bool("t", false, "")
 	flag.Parse()
 
+	// let any in-flight index write finish before this process exits,
+	// instead of racing it.
+	defer indexWG.Wait()
+
+	if *serveFlag {
+		daemonMode = true
+		if err := runServer(*socketPath); err != nil {
+			log.Fatalf("serve err=%v", err)
+		}
+		return
+	}
+
+	if *overlayFlag != "" {
+		ov, err := loadOverlayFile(*overlayFlag)
+		if err != nil {
+			log.Fatalf("load overlay=%s err=%v", *overlayFlag, err)
+		}
+		for path, body := range ov {
+			overlays[path] = body
+		}
+	}
+
 	*filename, _ = filepath.Abs(*filename)
 
+	if *stdin {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("read stdin err=%v", err)
+		}
+		overlays[*filename] = b
+	}
+
+	if *refsFlag {
+		// offset is 1-based, but token.File.Offset is 0-based.
+		*offset--
+		if *offset < 0 {
+			fail()
+		}
+
+		loadRecents()
+
+		myPkg, fs, _, chain := parseMyPkg()
+		target := findIdent(chain)
+		if target == nil {
+			fail()
+		}
+		lg("target is %v@%v", target, printPos(target.Pos()))
+
+		findRefs(myPkg, fs, target)
+		return
+	}
+
+	if pos, ok := tryDaemon(*socketPath, *filename, *offset, overlays); ok {
+		fmt.Println(pos)
+		return
+	}
+
 	// offset is 1-based, but token.File.Offset is 0-based.
 	*offset--
 	if *offset < 0 {
@@ -531,7 +828,13 @@ func main() {
 	}
 	lg("target is %v@%v", target, printPos(target.Pos()))
 
-	obj := parallelPass(myPkg, fs, target)
+	if pos, ok := findIndexedPos(myPkg, target); ok {
+		lg("find in on-disk index")
+		fmt.Println(pos)
+		return
+	}
+
+	obj := raceWithRecents(myPkg, fs, target)
 	lg("target=%v in otherpkg obj=%v", target, obj)
 
 	saveRecent(target, obj)
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// findRefs resolves target the same way a definition lookup would, then
+// walks every package in the enclosing module and prints every position
+// where the resolved object is used or redeclared.
+func findRefs(myPkg string, fs []*ast.File, target *ast.Ident) {
+	obj := twoPass(myPkg, fs, target)
+	if obj == nil {
+		obj = parseProgram(myPkg, fs, target)
+	}
+	if obj == nil || obj.Pkg() == nil || obj.Pos() == token.NoPos {
+		fail()
+	}
+	key := printPos(obj.Pos())
+	lg("refs: target=%v key=%s", target, key)
+
+	pattern := "./..."
+	if modPath, root := findModule(filepath.Dir(*filename)); root != "" {
+		pattern = modPath + "/..."
+	}
+
+	// Only list packages and their files here; resolving each package's own
+	// type info goes through the same on-disk index as a definition lookup
+	// (see refsInPackage), instead of asking packages.Load to type-check the
+	// whole module up front.
+	cfg := &packages.Config{
+		Mode:    packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedDeps | packages.NeedModule,
+		Dir:     filepath.Dir(*filename),
+		Overlay: overlays,
+	}
+	pkgs, err := packages.Load(cfg, pattern)
+	if err != nil {
+		log.Fatalf("refs: load program err=%v", err)
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		positions []string
+	)
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for _, pkg := range pkgs {
+		pkg := pkg
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			found := refsInPackage(pkg, key)
+			if len(found) == 0 {
+				return
+			}
+			mu.Lock()
+			positions = append(positions, found...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Strings(positions)
+	for _, pos := range positions {
+		fmt.Println(pos)
+	}
+}
+
+// refsInPackage finds every identifier in pkg whose resolved object was
+// declared at key (the target's own declaration position). When key lies in
+// one of pkg's own files and pkg's ActionID hasn't changed since the last
+// time it was indexed, it serves pkg's position table from the on-disk
+// index (the same index cacheIndex/readIndex a definition lookup uses).
+// Otherwise it type-checks pkg from source, caching the result. The index
+// table holds no cross-package entries, so every package other than the
+// one declaring the target is type-checked from source on each -refs call.
+func refsInPackage(pkg *packages.Package, key string) []string {
+	if len(pkg.CompiledGoFiles) == 0 {
+		return nil
+	}
+	modRoot, _ := findModule(filepath.Dir(pkg.CompiledGoFiles[0]))
+	id := actionID(modRoot, pkg.CompiledGoFiles, overlays)
+
+	declaredHere := false
+	for _, fn := range pkg.CompiledGoFiles {
+		declaredHere = declaredHere || strings.HasPrefix(key, fn+":")
+	}
+	if declaredHere {
+		if _, positions, ok := readIndex(pkg.PkgPath, id); ok {
+			return matchPositions(positions, key)
+		}
+	}
+
+	typPkg, info, ok := typeCheckForRefs(pkg)
+	if !ok {
+		return nil
+	}
+	cacheIndex(pkg.PkgPath, pkg.CompiledGoFiles, typPkg, info, overlays)
+	return matchInfo(info, key)
+}
+
+// typeCheckForRefs type-checks pkg's own files from source, resolving its
+// imports the same way a definition lookup's hybridImporter does: from the
+// in-memory view or on-disk index first, falling back to source. obj's
+// identity (and hence types.Object.Pos()) always names its declaration, for
+// both a Uses and a Defs entry, so comparing declaration positions later in
+// matchPositions/matchInfo is exact: unlike obj.Pkg().Path()+"."+obj.Name(),
+// it can't conflate two unrelated fields, params or locals that merely
+// share a name.
+func typeCheckForRefs(pkg *packages.Package) (*types.Package, *types.Info, bool) {
+	var fs []*ast.File
+	for _, fn := range pkg.CompiledGoFiles {
+		fs = append(fs, parseFile(fn, nil))
+	}
+
+	info := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	cfg := types.Config{
+		Importer: newHybridImporter(pkg.PkgPath),
+		Error:    func(err error) {},
+		DisableUnusedImportCheck: true,
+	}
+	typPkg, err := cfg.Check(pkg.PkgPath, fset, fs, info)
+	if err != nil && typPkg == nil {
+		lg("refs: type check pkg=%s err=%v", pkg.PkgPath, err)
+		return nil, nil, false
+	}
+	return typPkg, info, true
+}
+
+// matchPositions is the on-disk-index counterpart of matchInfo: positions
+// is the ident->def table cacheIndex already built for a package, so a hit
+// is just a filter instead of a walk over freshly type-checked info.
+func matchPositions(positions []posEntry, key string) []string {
+	var out []string
+	for _, p := range positions {
+		if p.Def == key {
+			out = append(out, p.Ident)
+		}
+	}
+	return out
+}
+
+func matchInfo(info *types.Info, key string) []string {
+	var out []string
+	check := func(id *ast.Ident, obj types.Object) {
+		if obj == nil || obj.Pos() == token.NoPos {
+			return
+		}
+		if printPos(obj.Pos()) != key {
+			return
+		}
+		out = append(out, printPos(id.Pos()))
+	}
+	for id, obj := range info.Uses {
+		check(id, obj)
+	}
+	for id, obj := range info.Defs {
+		check(id, obj)
+	}
+	return out
+}
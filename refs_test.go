@@ -0,0 +1,76 @@
+package main
+
+import (
+	"go/ast"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// TestMatchPositionsEquivalentToMatchInfo checks that refsInPackage's two
+// ways of finding references to the same declaration - the on-disk index's
+// cached position table (matchPositions) and a fresh type-check's
+// types.Info (matchInfo) - agree on a small fixture package. That's the
+// invariant a repeat -refs relies on: whichever path served pkg's result
+// for a given ActionID, the set of reported positions must be the same.
+func TestMatchPositionsEquivalentToMatchInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosym-refs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origIndexDir := indexDir
+	indexDir = dir
+	defer func() { indexDir = origIndexDir }()
+
+	const src = `package reftest
+
+func Sym() int { return 1 }
+
+func caller() int {
+	return Sym() + Sym()
+}
+`
+	f := parseFile("refs_test_fixture.go", []byte(src))
+	info := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	pkg, err := new(types.Config).Check("example.com/reftest", fset, []*ast.File{f}, info)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	key := printPos(pkg.Scope().Lookup("Sym").Pos())
+
+	wantFromInfo := matchInfo(info, key)
+	if len(wantFromInfo) != 3 { // Sym's own Defs entry plus its two call sites
+		t.Fatalf("matchInfo found %d references, want 3: %v", len(wantFromInfo), wantFromInfo)
+	}
+
+	fns := []string{"refs_test_fixture.go"}
+	cacheIndex("example.com/reftest", fns, pkg, info, overlays)
+
+	modRoot, _ := findModule(filepath.Dir(fns[0]))
+	id := actionID(modRoot, fns, overlays)
+	_, positions, ok := readIndex("example.com/reftest", id)
+	if !ok {
+		t.Fatal("expected cacheIndex to have written an index entry")
+	}
+	gotFromPositions := matchPositions(positions, key)
+
+	sort.Strings(wantFromInfo)
+	sort.Strings(gotFromPositions)
+	if len(wantFromInfo) != len(gotFromPositions) {
+		t.Fatalf("matchPositions=%v, matchInfo=%v", gotFromPositions, wantFromInfo)
+	}
+	for i := range wantFromInfo {
+		if wantFromInfo[i] != gotFromPositions[i] {
+			t.Fatalf("matchPositions=%v, matchInfo=%v", gotFromPositions, wantFromInfo)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"go/types"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errNoIdent = errors.New("no identifier found")
+
+// view is the daemon's in-memory cache of type-checked dependency
+// packages, keyed by import path. It is what lets a repeat -serve request
+// skip type-checking a package whose files haven't changed, instead of
+// just saving process-startup cost the way a bare one-shot-per-connection
+// server would.
+type view struct {
+	mu   sync.Mutex
+	pkgs map[string]*viewEntry
+}
+
+type viewEntry struct {
+	id  string
+	pkg *types.Package
+}
+
+var theView = &view{pkgs: make(map[string]*viewEntry)}
+
+// get returns the cached package for path if its ActionID still matches id.
+func (v *view) get(path, id string) (*types.Package, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	e, ok := v.pkgs[path]
+	if !ok || e.id != id {
+		return nil, false
+	}
+	return e.pkg, true
+}
+
+func (v *view) put(path, id string, pkg *types.Package) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.pkgs[path] = &viewEntry{id: id, pkg: pkg}
+}
+
+// viewActionID computes the same ActionID the on-disk index uses, so the
+// daemon's hot in-memory cache and the on-disk cache invalidate together.
+func viewActionID(path string) (id string, ok bool) {
+	fns, _ := pkgFiles(path)
+	if len(fns) == 0 {
+		return "", false
+	}
+	modRoot, _ := findModule(filepath.Dir(fns[0]))
+	return actionID(modRoot, fns, overlays), true
+}
+
+// defRequest is what a client sends to the daemon: the same {file, offset}
+// cursor the CLI takes on the command line, plus any unsaved-buffer content
+// (from stdin and/or -overlay) keyed by absolute path.
+type defRequest struct {
+	File     string
+	Offset   int
+	Overlays map[string]string
+}
+
+type defResponse struct {
+	Pos string
+	Err string
+}
+
+// viewMu serializes daemon requests against the package-level state
+// (*filename, *offset, fset, recents, ...) that the single-process CLI
+// code was written to mutate freely.
+var viewMu sync.Mutex
+
+// fsetResetInterval bounds how many requests share one token.FileSet:
+// every request parses its files into the same package-level fset, so
+// without a periodic reset a resident daemon's fset (and the ASTs and
+// positions it retains) would grow without bound over its lifetime.
+const fsetResetInterval = 500
+
+var requestCount int
+
+// maybeResetFset replaces fset once every fsetResetInterval requests. It
+// also clears theView, since a cached *types.Package holds token.Pos values
+// that only mean anything relative to the fset that was live when it was
+// type-checked; keeping the view around after swapping fset out from under
+// it would make every cached package's positions wrong. Called under
+// viewMu, so this never races a request that's still using the old fset.
+func maybeResetFset() {
+	requestCount++
+	if requestCount%fsetResetInterval != 0 {
+		return
+	}
+	lg("reset fset after %d requests", requestCount)
+	fset = token.NewFileSet()
+	theView = &view{pkgs: make(map[string]*viewEntry)}
+}
+
+func runServer(sockPath string) error {
+	os.Remove(sockPath)
+	if err := os.MkdirAll(filepath.Dir(sockPath), 0700); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	lg("gosym serving on %s", sockPath)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			lg("accept err=%v", err)
+			continue
+		}
+		go handleConn(conn)
+	}
+}
+
+func handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req defRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		lg("decode request err=%v", err)
+		return
+	}
+
+	pos, err := handleDefRequest(req)
+	resp := defResponse{Pos: pos}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		lg("encode response err=%v", err)
+	}
+}
+
+// handleDefRequest resolves one request the same way the one-shot CLI
+// does, minus the recents-race-and-exit and godef shortcuts that only make
+// sense in a process that's about to terminate anyway. Dependency packages
+// type-checked while serving an earlier request are reused from theView
+// (see hybridImporter.Import) instead of being reparsed and retyped, and
+// the recents cache is loaded from disk once per daemon lifetime rather
+// than on every request.
+func handleDefRequest(req defRequest) (pos string, err error) {
+	viewMu.Lock()
+	defer viewMu.Unlock()
+
+	maybeResetFset()
+
+	fn, err := filepath.Abs(req.File)
+	if err != nil {
+		return "", err
+	}
+	*filename = fn
+	*offset = req.Offset - 1
+	if *offset < 0 {
+		return "", errNoIdent
+	}
+
+	overlays = make(map[string][]byte, len(req.Overlays))
+	for path, body := range req.Overlays {
+		overlays[path] = []byte(body)
+	}
+	resetPkgFilesCache()
+
+	if recents == nil {
+		loadRecents()
+	}
+
+	myPkg, fs, _, chain := parseMyPkg()
+	if fs == nil {
+		return "", errNoIdent
+	}
+	target := findIdent(chain)
+	if target == nil {
+		return "", errNoIdent
+	}
+	lg("target is %v@%v", target, printPos(target.Pos()))
+
+	if pos, ok := findRecentPos(target); ok {
+		lg("find in recent")
+		return pos, nil
+	}
+	if pos, ok := findIndexedPos(myPkg, target); ok {
+		lg("find in on-disk index")
+		return pos, nil
+	}
+
+	obj := parallelPass(myPkg, fs, target)
+	lg("target=%v in otherpkg obj=%v", target, obj)
+	saveRecent(target, obj)
+
+	if obj == nil || obj.Pos() == token.NoPos {
+		return "", errNoIdent
+	}
+	return printPos(obj.Pos()), nil
+}
+
+// tryDaemon asks a running daemon to resolve the request, spawning one at
+// sockPath if none is listening yet. ok is false whenever the daemon
+// couldn't be reached or didn't find the identifier, so the caller can fall
+// back to resolving in-process.
+func tryDaemon(sockPath, fn string, offset int, overlays map[string][]byte) (pos string, ok bool) {
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		conn, err = spawnDaemon(sockPath)
+	}
+	if err != nil {
+		lg("connect daemon err=%v", err)
+		return "", false
+	}
+	defer conn.Close()
+
+	req := defRequest{File: fn, Offset: offset}
+	if len(overlays) > 0 {
+		req.Overlays = make(map[string]string, len(overlays))
+		for path, body := range overlays {
+			req.Overlays[path] = string(body)
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		lg("send request to daemon err=%v", err)
+		return "", false
+	}
+
+	var resp defResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		lg("read daemon response err=%v", err)
+		return "", false
+	}
+	if resp.Err != "" {
+		lg("daemon err=%v", resp.Err)
+		return "", false
+	}
+	return resp.Pos, true
+}
+
+func spawnDaemon(sockPath string) (net.Conn, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(exe, "-serve", "-socket", sockPath)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < 20; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if conn, err := net.Dial("unix", sockPath); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("daemon did not come up at %s", sockPath)
+}